@@ -17,6 +17,8 @@ package objectnode
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/chubaofs/chubaofs/proto"
 
@@ -24,33 +26,217 @@ import (
 	"github.com/chubaofs/chubaofs/util/log"
 )
 
+const (
+	// defaultVolumeMaxEntries bounds the number of *Volume instances a
+	// VolumeManager will keep resident at once. Gateways fronting many
+	// thousands of buckets would otherwise grow this map without limit.
+	defaultVolumeMaxEntries = 1024
+
+	// defaultVolumeIdleTimeout is how long a volume may sit unused before
+	// it becomes eligible for eviction.
+	defaultVolumeIdleTimeout = 30 * time.Minute
+
+	// volumeEvictionScanInterval controls how often the background
+	// eviction goroutine scans for idle or over-capacity volumes.
+	volumeEvictionScanInterval = time.Minute
+)
+
+// volumeEntry wraps a *Volume with the bookkeeping needed for LRU/TTL
+// eviction: the last time it was checked out and how many callers currently
+// hold a reference to it. A volume is only closed once it has been evicted
+// (removed from the live map) and its refCount has dropped to zero.
+type volumeEntry struct {
+	name     string
+	vol      *Volume
+	lastUsed int64 // unix nano, accessed atomically
+	refCount int32 // number of in-flight checkouts, accessed atomically
+	evicted  int32 // 1 once removed from the map and pending close, 2 once closed
+}
+
+func newVolumeEntry(name string, vol *Volume) *volumeEntry {
+	return &volumeEntry{
+		name:     name,
+		vol:      vol,
+		lastUsed: time.Now().UnixNano(),
+	}
+}
+
+func (e *volumeEntry) touch() {
+	atomic.StoreInt64(&e.lastUsed, time.Now().UnixNano())
+}
+
+// pin refreshes lastUsed and bumps refCount. Callers must hold at least
+// m.volMu's read lock when calling pin, so that Release/evictIdle/
+// evictOldest - which need the write lock to remove an entry from the map
+// before they'll close it - cannot run between a lookup that finds the
+// entry and the refCount bump that's supposed to keep it alive.
+func (e *volumeEntry) pin() {
+	e.touch()
+	atomic.AddInt32(&e.refCount, 1)
+}
+
+func (e *volumeEntry) idleSince() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&e.lastUsed)))
+}
+
+// closeVolume is indirected through a variable so tests can stub it out
+// without standing up a real *Volume.
+var closeVolume = func(v *Volume) error {
+	return v.Close()
+}
+
+// newVolumeFunc is indirected through a variable so tests can stub out
+// volume creation without standing up a real cluster.
+var newVolumeFunc = NewVolume
+
+// closeIfUnused closes the wrapped volume once it has been marked evicted
+// and no caller still holds a reference to it. Only the first call that sees
+// both conditions closes it; concurrent or later calls return false.
+func (e *volumeEntry) closeIfUnused() bool {
+	if atomic.LoadInt32(&e.refCount) == 0 && atomic.CompareAndSwapInt32(&e.evicted, 1, 2) {
+		if closeErr := closeVolume(e.vol); closeErr != nil {
+			log.LogErrorf("closeIfUnused: close volume fail: volume(%v) err(%v)", e.name, closeErr)
+		}
+		return true
+	}
+	return false
+}
+
+// VolumeStats is a point-in-time snapshot of VolumeManager's cache counters.
+type VolumeStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
 type VolumeManager struct {
 	masters    []string
 	mc         *master.MasterClient
-	volumes    map[string]*Volume // mapping: volume name -> *Volume
+	volumes    map[string]*volumeEntry // mapping: volume name -> *volumeEntry
 	volMu      sync.RWMutex
 	volInitMap sync.Map // mapping: volume name -> *sync.Mutex
+	kekInitMap sync.Map // mapping: volume name -> *sync.Mutex
 	store      Store
+	kms        KMSClient
+	metrics    *volumeMetricsRegistry
 	closeOnce  sync.Once
+
+	maxEntries  int
+	idleTimeout time.Duration
+	stopCh      chan struct{}
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
 }
 
+// SetKMSClient configures the KMSClient used to wrap/unwrap bucket
+// key-encryption keys for SSE-S3 and SSE-KMS. See kms.go and sse.go.
+func (m *VolumeManager) SetKMSClient(kms KMSClient) {
+	m.volMu.Lock()
+	m.kms = kms
+	m.volMu.Unlock()
+}
+
+// Release marks volName for eviction: it is immediately removed from the
+// live map so no new Acquire can find it, but the underlying *Volume is only
+// closed once every handle already checked out via Acquire has been
+// released. Callers that want the volume gone right away still just call
+// this; callers mid-request holding a *VolumeHandle are what keeps it alive
+// until they're done.
 func (m *VolumeManager) Release(volName string) {
 	m.volMu.Lock()
-	vol, has := m.volumes[volName]
+	entry, has := m.volumes[volName]
 	if has {
 		delete(m.volumes, volName)
-		log.LogDebugf("Release: release volume: volume(%v)", volName)
+		atomic.StoreInt32(&entry.evicted, 1)
+		log.LogDebugf("Release: marked volume for eviction: volume(%v)", volName)
 	}
 	m.volMu.Unlock()
-	if has && vol != nil {
-		if closeErr := vol.Close(); closeErr != nil {
-			log.LogErrorf("Release: close volume fail: volume(%v) err(%v)", volName, closeErr)
-		}
+	if has {
+		entry.closeIfUnused()
+	}
+}
+
+// VolumeHandle is a checked-out reference to a *Volume obtained from
+// Acquire. Callers must call Release exactly once when done with it; the
+// underlying volume is only closed once every outstanding handle for it has
+// been released, even if it was evicted or marked for eviction in the
+// meantime. VolumeManager.Close is the exception: it closes every volume
+// still in the cache whether or not handles for it are outstanding.
+type VolumeHandle struct {
+	name  string
+	entry *volumeEntry
+	vm    *VolumeManager
+	once  sync.Once
+}
+
+// Volume returns the checked-out *Volume. It stays safe to use until
+// Release is called.
+func (h *VolumeHandle) Volume() *Volume {
+	return h.entry.vol
+}
+
+// Release gives up this handle's reference to the volume. It is safe to
+// call more than once; only the first call has any effect.
+func (h *VolumeHandle) Release() {
+	h.once.Do(func() {
+		h.vm.releaseHandle(h.entry)
+	})
+}
+
+// Acquire checks out volName, loading it if necessary, and returns a
+// VolumeHandle holding a reference that keeps the volume alive until
+// handle.Release is called. This replaces the old Volume() accessor, which
+// let a goroutine still mid-request crash against a volume that Release had
+// already closed out from under it.
+func (m *VolumeManager) Acquire(volName string) (*VolumeHandle, error) {
+	// loadVolume already returns the entry pinned (refCount bumped under
+	// volMu); pinning again here would just leak a reference, since a
+	// matching handle.Release only ever undoes one pin.
+	entry, err := m.loadVolume(volName)
+	if err != nil {
+		return nil, err
 	}
+	return &VolumeHandle{name: volName, entry: entry, vm: m}, nil
 }
 
-func (m *VolumeManager) Volume(volName string) (*Volume, error) {
-	return m.loadVolume(volName)
+func (m *VolumeManager) releaseHandle(entry *volumeEntry) {
+	if atomic.AddInt32(&entry.refCount, -1) < 0 {
+		atomic.StoreInt32(&entry.refCount, 0)
+	}
+	entry.closeIfUnused()
+}
+
+// pinForBackground pins entry for the duration of a background operation
+// (e.g. metrics collection) that must not reset the idle timer the way a
+// request-driven pin via touch() would. It returns false, leaving entry
+// unpinned, if entry is no longer the live cache entry for volName - the
+// caller should treat that as "this volume is gone" and stop. The caller
+// must release the pin with releaseHandle when done.
+func (m *VolumeManager) pinForBackground(volName string, entry *volumeEntry) bool {
+	m.volMu.RLock()
+	defer m.volMu.RUnlock()
+	if m.volumes[volName] != entry {
+		return false
+	}
+	atomic.AddInt32(&entry.refCount, 1)
+	return true
+}
+
+// Stats returns a snapshot of the cache's hit/miss/eviction counters and its
+// current size.
+func (m *VolumeManager) Stats() VolumeStats {
+	m.volMu.RLock()
+	size := len(m.volumes)
+	m.volMu.RUnlock()
+	return VolumeStats{
+		Hits:      atomic.LoadUint64(&m.hits),
+		Misses:    atomic.LoadUint64(&m.misses),
+		Evictions: atomic.LoadUint64(&m.evictions),
+		Size:      size,
+	}
 }
 
 func (m *VolumeManager) syncVolumeInit(volume string) (releaseFunc func()) {
@@ -65,69 +251,259 @@ func (m *VolumeManager) syncVolumeInit(volume string) (releaseFunc func()) {
 	}
 }
 
-func (m *VolumeManager) loadVolume(volName string) (*Volume, error) {
+// syncKEKInit serializes first-time bucket KEK provisioning per volume, the
+// same way syncVolumeInit serializes volume creation: without it, two
+// concurrent callers that both observe no WrappedKEK yet would each generate
+// and persist their own key, and whichever write loses would leave objects
+// encrypted under the other caller's key permanently unrecoverable.
+func (m *VolumeManager) syncKEKInit(volume string) (releaseFunc func()) {
+	value, _ := m.kekInitMap.LoadOrStore(volume, new(sync.Mutex))
+	var initMu = value.(*sync.Mutex)
+	initMu.Lock()
+	return func() {
+		initMu.Unlock()
+		m.kekInitMap.Delete(volume)
+	}
+}
+
+// loadVolume finds or creates volName's entry and returns it already pinned
+// (refCount bumped), so the entry it hands back can never have been closed
+// out from under the caller: the bump always happens while still holding
+// volMu, before any concurrent Release/evictIdle/evictOldest can observe
+// refCount==0 and tear the volume down.
+func (m *VolumeManager) loadVolume(volName string) (*volumeEntry, error) {
 	var err error
-	var volume *Volume
+	var entry *volumeEntry
 	var exist bool
 	m.volMu.RLock()
-	volume, exist = m.volumes[volName]
+	entry, exist = m.volumes[volName]
+	if exist {
+		entry.pin()
+	}
 	m.volMu.RUnlock()
-	if !exist {
-		var release = m.syncVolumeInit(volName)
-		m.volMu.RLock()
-		volume, exist = m.volumes[volName]
-		if exist {
-			m.volMu.RUnlock()
-			release()
-			return volume, nil
+	if exist {
+		atomic.AddUint64(&m.hits, 1)
+		return entry, nil
+	}
+
+	var release = m.syncVolumeInit(volName)
+	m.volMu.RLock()
+	entry, exist = m.volumes[volName]
+	if exist {
+		entry.pin()
+	}
+	m.volMu.RUnlock()
+	if exist {
+		release()
+		atomic.AddUint64(&m.hits, 1)
+		return entry, nil
+	}
+	atomic.AddUint64(&m.misses, 1)
+
+	var onAsyncTaskError AsyncTaskErrorFunc = func(err error) {
+		switch err {
+		case proto.ErrVolNotExists:
+			m.Release(volName)
+		default:
 		}
+	}
+	var config = &VolumeConfig{
+		Volume:           volName,
+		Masters:          m.masters,
+		OnAsyncTaskError: onAsyncTaskError,
+	}
+	var volume *Volume
+	if volume, err = newVolumeFunc(config); err != nil {
+		release()
+		return nil, err
+	}
+	ak, sk := volume.OSSSecure()
+	log.LogDebugf("[loadVolume] load Volume: Name[%v] AccessKey[%v] SecretKey[%v]", volName, ak, sk)
+
+	if !m.hydrateFromStore(volName, volume) {
+		volume.loadOSSMeta()
+	}
+
+	entry = newVolumeEntry(volName, volume)
+	m.volMu.Lock()
+	entry.pin()
+	m.volumes[volName] = entry
+	volume.vm = m
+	m.volMu.Unlock()
+	release()
+
+	m.evictOverCapacity()
+	m.scheduleMetricsCollection(volName, entry)
+
+	return entry, nil
+}
+
+// hydrateFromStore attempts to populate volume's OSS metadata (access keys,
+// CORS, policy, lifecycle, tagging) from the persistent store, saving a
+// round trip to the master on cold start. It reports whether hydration
+// succeeded; callers should fall back to fetching from the master otherwise.
+func (m *VolumeManager) hydrateFromStore(volName string, volume *Volume) bool {
+	if m.store == nil {
+		return false
+	}
+	meta, err := m.store.Get(volName)
+	if err != nil {
+		log.LogErrorf("hydrateFromStore: load volume(%v) from store fail: err(%v)", volName, err)
+		return false
+	}
+	if meta == nil {
+		return false
+	}
+	volume.hydrateOSSMeta(meta)
+	return true
+}
+
+// evictOverCapacity evicts the least-recently-used, currently-unreferenced
+// volumes until the cache is back within maxEntries.
+func (m *VolumeManager) evictOverCapacity() {
+	if m.maxEntries <= 0 {
+		return
+	}
+	for {
+		m.volMu.RLock()
+		over := len(m.volumes) - m.maxEntries
 		m.volMu.RUnlock()
+		if over <= 0 {
+			return
+		}
+		if !m.evictOldest() {
+			return
+		}
+	}
+}
 
-		var onAsyncTaskError AsyncTaskErrorFunc = func(err error) {
-			switch err {
-			case proto.ErrVolNotExists:
-				m.Release(volName)
-			default:
-			}
+// evictOldest evicts the single least-recently-used volume that has no
+// in-flight checkouts. It returns false if there was nothing evictable.
+func (m *VolumeManager) evictOldest() bool {
+	var oldestName string
+	var oldestEntry *volumeEntry
+	m.volMu.RLock()
+	for name, entry := range m.volumes {
+		if atomic.LoadInt32(&entry.refCount) != 0 {
+			continue
 		}
-		var config = &VolumeConfig{
-			Volume:           volName,
-			Masters:          m.masters,
-			OnAsyncTaskError: onAsyncTaskError,
+		if oldestEntry == nil || atomic.LoadInt64(&entry.lastUsed) < atomic.LoadInt64(&oldestEntry.lastUsed) {
+			oldestName, oldestEntry = name, entry
 		}
-		if volume, err = NewVolume(config); err != nil {
-			release()
-			return nil, err
+	}
+	m.volMu.RUnlock()
+	if oldestEntry == nil {
+		return false
+	}
+	m.volMu.Lock()
+	if current, ok := m.volumes[oldestName]; !ok || current != oldestEntry {
+		m.volMu.Unlock()
+		return true
+	}
+	delete(m.volumes, oldestName)
+	m.volMu.Unlock()
+	atomic.StoreInt32(&oldestEntry.evicted, 1)
+	atomic.AddUint64(&m.evictions, 1)
+	oldestEntry.closeIfUnused()
+	log.LogDebugf("evictOldest: evicted idle volume: volume(%v)", oldestName)
+	return true
+}
+
+// evictIdleLoop periodically closes volumes that have not been used for
+// longer than idleTimeout, until Close stops the manager.
+func (m *VolumeManager) evictIdleLoop() {
+	ticker := time.NewTicker(volumeEvictionScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.evictIdle()
+		case <-m.stopCh:
+			return
 		}
-		ak, sk := volume.OSSSecure()
-		log.LogDebugf("[loadVolume] load Volume: Name[%v] AccessKey[%v] SecretKey[%v]", volName, ak, sk)
+	}
+}
 
+func (m *VolumeManager) evictIdle() {
+	if m.idleTimeout <= 0 {
+		return
+	}
+	var idleNames []string
+	m.volMu.RLock()
+	for name, entry := range m.volumes {
+		if entry.idleSince() >= m.idleTimeout {
+			idleNames = append(idleNames, name)
+		}
+	}
+	m.volMu.RUnlock()
+
+	for _, name := range idleNames {
 		m.volMu.Lock()
-		m.volumes[volName] = volume
-		volume.vm = m
+		entry, ok := m.volumes[name]
+		if !ok || entry.idleSince() < m.idleTimeout {
+			m.volMu.Unlock()
+			continue
+		}
+		delete(m.volumes, name)
 		m.volMu.Unlock()
-		release()
-
-		volume.loadOSSMeta()
+		atomic.StoreInt32(&entry.evicted, 1)
+		atomic.AddUint64(&m.evictions, 1)
+		entry.closeIfUnused()
+		log.LogDebugf("evictIdle: evicted idle volume: volume(%v)", name)
 	}
-
-	return volume, nil
 }
 
 // Release all
 func (m *VolumeManager) Close() {
+	m.closeOnce.Do(func() {
+		close(m.stopCh)
+	})
 	m.volMu.Lock()
 	defer m.volMu.Unlock()
-	for volKey, vol := range m.volumes {
-		_ = vol.Close()
+	for volKey, entry := range m.volumes {
+		_ = closeVolume(entry.vol)
 		log.LogDebugf("release Volume %v", volKey)
 	}
-	m.volumes = make(map[string]*Volume)
+	m.volumes = make(map[string]*volumeEntry)
 }
 
 func (m *VolumeManager) InitStore(s Store) {
 	s.Init(m)
 	m.store = s
+	if err := m.Refresh(); err != nil {
+		log.LogErrorf("InitStore: refresh volume store fail: err(%v)", err)
+	}
+}
+
+// Refresh reconciles the persisted volume records against the master on
+// startup, dropping records for volumes the master no longer knows about so
+// a deleted bucket does not keep hydrating stale credentials forever.
+func (m *VolumeManager) Refresh() error {
+	if m.store == nil {
+		return nil
+	}
+	all, err := m.store.List()
+	if err != nil {
+		return err
+	}
+	mc, err := m.GetMasterClient()
+	if err != nil {
+		return err
+	}
+	for volName := range all {
+		if _, statErr := mc.AdminAPI().GetVolumeSimpleInfo(volName); statErr != nil {
+			if statErr != proto.ErrVolNotExists {
+				log.LogErrorf("Refresh: check volume(%v) against master fail: err(%v)", volName, statErr)
+				continue
+			}
+			if delErr := m.store.Delete(volName); delErr != nil {
+				log.LogErrorf("Refresh: drop stale volume(%v) record fail: err(%v)", volName, delErr)
+				continue
+			}
+			log.LogDebugf("Refresh: dropped stale volume(%v) record", volName)
+		}
+	}
+	return nil
 }
 
 func (m *VolumeManager) GetStore() (Store, error) {
@@ -150,8 +526,24 @@ func (m *VolumeManager) GetMasterClient() (*master.MasterClient, error) {
 
 func NewVolumeManager(masters []string) *VolumeManager {
 	vc := &VolumeManager{
-		volumes: make(map[string]*Volume),
-		masters: masters,
+		volumes:     make(map[string]*volumeEntry),
+		masters:     masters,
+		maxEntries:  defaultVolumeMaxEntries,
+		idleTimeout: defaultVolumeIdleTimeout,
+		stopCh:      make(chan struct{}),
+		metrics:     newVolumeMetricsRegistry(),
 	}
+	go vc.evictIdleLoop()
 	return vc
 }
+
+// SetCachePolicy overrides the default LRU size bound and idle timeout used
+// to evict volumes. A non-positive maxEntries disables the size bound, and a
+// non-positive idleTimeout disables TTL eviction. Callers typically invoke
+// this right after NewVolumeManager, before any volume is loaded.
+func (m *VolumeManager) SetCachePolicy(maxEntries int, idleTimeout time.Duration) {
+	m.volMu.Lock()
+	m.maxEntries = maxEntries
+	m.idleTimeout = idleTimeout
+	m.volMu.Unlock()
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubCloseVolume replaces closeVolume with a counting stub, returning a
+// restore func, so the refcount/eviction invariants can be exercised without
+// a live cluster backing a real *Volume.
+func stubCloseVolume() (closed *int32, restore func()) {
+	closed = new(int32)
+	prev := closeVolume
+	closeVolume = func(v *Volume) error {
+		atomic.AddInt32(closed, 1)
+		return nil
+	}
+	return closed, func() { closeVolume = prev }
+}
+
+// stubNewVolume replaces newVolumeFunc with a stub returning a bare *Volume,
+// restoring the original on cleanup, so loadVolume's cache-miss path can run
+// without a live cluster backing a real *Volume.
+func stubNewVolume() (restore func()) {
+	prev := newVolumeFunc
+	newVolumeFunc = func(config *VolumeConfig) (*Volume, error) {
+		return &Volume{}, nil
+	}
+	return func() { newVolumeFunc = prev }
+}
+
+// newTestVolumeManager builds a VolumeManager with a single pre-populated
+// volume entry, bypassing NewVolume/master calls so it can be exercised
+// without a live cluster.
+func newTestVolumeManager(volName string) (*VolumeManager, *volumeEntry) {
+	vm := NewVolumeManager(nil)
+	entry := newVolumeEntry(volName, &Volume{})
+	vm.volumes[volName] = entry
+	return vm, entry
+}
+
+func TestAcquireRelease_HandleBlocksCloseUntilReleased(t *testing.T) {
+	const volName = "ltptest"
+	closed, restore := stubCloseVolume()
+	defer restore()
+	vm, _ := newTestVolumeManager(volName)
+	defer vm.Close()
+
+	handle, err := vm.Acquire(volName)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	// Simulate the async proto.ErrVolNotExists callback racing with the
+	// in-flight request holding handle: Release must not close the volume
+	// while a handle is still outstanding.
+	vm.Release(volName)
+	if atomic.LoadInt32(closed) != 0 {
+		t.Fatalf("volume closed while a handle was still outstanding")
+	}
+
+	handle.Release()
+	if atomic.LoadInt32(closed) != 1 {
+		t.Fatalf("volume was not closed after its last handle was released: closed=%v", atomic.LoadInt32(closed))
+	}
+
+	// A second Release must be a no-op, not a double-close.
+	handle.Release()
+	if atomic.LoadInt32(closed) != 1 {
+		t.Fatalf("releasing a handle twice closed the volume twice: closed=%v", atomic.LoadInt32(closed))
+	}
+}
+
+func TestAcquireRelease_ConcurrentAcquireRacesAsyncEviction(t *testing.T) {
+	const volName = "ltptest"
+	closed, restore := stubCloseVolume()
+	defer restore()
+	defer stubNewVolume()()
+	vm, entry := newTestVolumeManager(volName)
+	defer vm.Close()
+	// Acquires that lose the race to Release reload the volume; a stored
+	// record lets that reload hydrate from the store instead of asking the
+	// master for OSS metadata.
+	store := newMemStore()
+	_ = store.Put(volName, &VolumeMeta{})
+	vm.store = store
+
+	const concurrency = 64
+	var wg sync.WaitGroup
+	wg.Add(concurrency + 1)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			handle, err := vm.Acquire(volName)
+			if err != nil {
+				t.Errorf("Acquire: %v", err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+			handle.Release()
+		}()
+	}
+
+	// Race an eviction, as triggered by an async proto.ErrVolNotExists
+	// callback, against the concurrent acquires.
+	go func() {
+		defer wg.Done()
+		vm.Release(volName)
+	}()
+
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&entry.refCount); got != 0 {
+		t.Fatalf("refCount leaked: got %v, want 0", got)
+	}
+	if atomic.LoadInt32(closed) != 1 {
+		t.Fatalf("volume should be closed exactly once once every handle is released: closed=%v", atomic.LoadInt32(closed))
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/chubaofs/chubaofs/sdk/master"
+	"github.com/chubaofs/chubaofs/util/log"
+)
+
+// AsyncTaskErrorFunc is invoked when loading a Volume's OSS metadata from
+// the master (loadOSSMeta) hits an error the
+// Volume itself can't act on, so the owning VolumeManager can decide what to
+// do about it - typically Release the volume if the error means it no
+// longer exists on the master.
+type AsyncTaskErrorFunc func(err error)
+
+// VolumeConfig carries everything NewVolume needs to stand up a *Volume.
+type VolumeConfig struct {
+	Volume           string
+	Masters          []string
+	OnAsyncTaskError AsyncTaskErrorFunc
+}
+
+// volumeUsage is the result of walkUsage, used by CollectorFull.
+// CollectorFast reads the same figures through statFS and
+// approximateObjectCount instead.
+type volumeUsage struct {
+	Capacity    uint64
+	Used        uint64
+	InodesUsed  uint64
+	ObjectCount uint64
+}
+
+// Volume is a gateway's local handle onto one ChubaoFS volume: its OSS
+// credentials and bucket configuration (CORS/policy/lifecycle/tagging), plus
+// the master client used to refresh them and the volume's usage figures. vm
+// is set by VolumeManager.loadVolume once the Volume has been registered in
+// the manager's cache, and is nil before that.
+type Volume struct {
+	name             string
+	mc               *master.MasterClient
+	onAsyncTaskError AsyncTaskErrorFunc
+	vm               *VolumeManager
+
+	mu        sync.RWMutex
+	accessKey string
+	secretKey string
+	cors      []byte
+	policy    []byte
+	lifecycle []byte
+	tagging   []byte
+}
+
+// NewVolume creates the *Volume described by config. It does not itself
+// fetch anything from the master; callers populate OSS metadata separately
+// via hydrateOSSMeta (from a persisted Store record) or loadOSSMeta (a fresh
+// fetch from the master).
+func NewVolume(config *VolumeConfig) (*Volume, error) {
+	if config == nil || config.Volume == "" {
+		return nil, errors.New("volume name required")
+	}
+	return &Volume{
+		name:             config.Volume,
+		mc:               master.NewMasterClient(config.Masters, false),
+		onAsyncTaskError: config.OnAsyncTaskError,
+	}, nil
+}
+
+// OSSSecure returns the volume's current OSS access/secret key pair.
+func (v *Volume) OSSSecure() (accessKey, secretKey string) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.accessKey, v.secretKey
+}
+
+// hydrateOSSMeta populates the volume's OSS credentials and bucket
+// configuration from a persisted Store record, saving loadVolume a round
+// trip to the master on cold start.
+func (v *Volume) hydrateOSSMeta(meta *VolumeMeta) {
+	v.mu.Lock()
+	v.accessKey = meta.AccessKey
+	v.secretKey = meta.SecretKey
+	v.cors = meta.CORS
+	v.policy = meta.Policy
+	v.lifecycle = meta.Lifecycle
+	v.tagging = meta.Tagging
+	v.mu.Unlock()
+}
+
+// loadOSSMeta fetches the volume's OSS credentials from the master, for use
+// on cold start when hydrateFromStore found nothing cached. Any failure is
+// reported to onAsyncTaskError rather than returned, since loadVolume treats
+// a failed OSS metadata load as non-fatal to acquiring the volume.
+func (v *Volume) loadOSSMeta() {
+	view, err := v.mc.ClientAPI().GetVolumeWithoutAuthKey(v.name)
+	if err != nil {
+		log.LogErrorf("loadOSSMeta: get volume(%v) fail: err(%v)", v.name, err)
+		if v.onAsyncTaskError != nil {
+			v.onAsyncTaskError(err)
+		}
+		return
+	}
+	if view.OSSSecure == nil {
+		return
+	}
+	v.mu.Lock()
+	v.accessKey = view.OSSSecure.AccessKey
+	v.secretKey = view.OSSSecure.SecretKey
+	v.mu.Unlock()
+}
+
+// statFS returns the volume's capacity, used bytes and inode count as last
+// reported by the master's periodic aggregation - a cheap, metadata-only
+// read with no namespace walk of its own.
+func (v *Volume) statFS() (capacity, used, inodesUsed uint64, err error) {
+	info, err := v.mc.ClientAPI().GetVolumeStat(v.name)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return info.TotalSize, info.UsedSize, info.InodeCount, nil
+}
+
+// approximateObjectCount estimates the volume's object count from its inode
+// count, the same master-reported aggregate statFS uses. It is an
+// approximation because a volume's inode count also includes directories,
+// but it is cheap enough to refresh on every CollectorFast pass.
+func (v *Volume) approximateObjectCount() (uint64, error) {
+	info, err := v.mc.ClientAPI().GetVolumeStat(v.name)
+	if err != nil {
+		return 0, err
+	}
+	return info.InodeCount, nil
+}
+
+// walkUsage returns exact usage figures for the volume. Capacity/used/inodes
+// already come from the master's own aggregation, so there is nothing a
+// local namespace walk would refine for those; only ObjectCount benefits
+// from one, but this gateway has no metadata-partition walker of its own,
+// so it reports the same inode-count approximation approximateObjectCount
+// does. Collectors that need an exact object count should be backed by a
+// VolumeMetricsCollector that has its own namespace walker rather than
+// relying on this default.
+func (v *Volume) walkUsage() (volumeUsage, error) {
+	info, err := v.mc.ClientAPI().GetVolumeStat(v.name)
+	if err != nil {
+		return volumeUsage{}, err
+	}
+	return volumeUsage{
+		Capacity:    info.TotalSize,
+		Used:        info.UsedSize,
+		InodesUsed:  info.InodeCount,
+		ObjectCount: info.InodeCount,
+	}, nil
+}
+
+// Close releases any resources held by the volume. There is nothing to
+// release today - no background goroutines or open handles are owned
+// directly by Volume - but the closeVolume hook always calls it so a
+// future volume-scoped resource has somewhere to hook its teardown.
+func (v *Volume) Close() error {
+	return nil
+}
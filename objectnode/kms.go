@@ -0,0 +1,210 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// KMSClient wraps and unwraps key material (typically a bucket's
+// key-encryption key) under a named master key held by the KMS. Volume and
+// VolumeManager never see plaintext master keys, only the results of
+// Wrap/Unwrap.
+type KMSClient interface {
+	WrapKey(keyName string, plaintext []byte) (ciphertext []byte, err error)
+	UnwrapKey(keyName string, ciphertext []byte) (plaintext []byte, err error)
+}
+
+// VaultKMSClient wraps/unwraps key material using Vault's transit secrets
+// engine, authenticating with either a static token or AppRole credentials.
+type VaultKMSClient struct {
+	Addr          string
+	Token         string
+	AppRoleID     string
+	AppRoleSecret string
+	HTTPClient    *http.Client
+
+	mu        sync.Mutex
+	loginDone bool
+}
+
+// NewVaultKMSClient builds a VaultKMSClient authenticating with a static
+// token. Use NewVaultAppRoleKMSClient for AppRole-based auth.
+func NewVaultKMSClient(addr, token string) *VaultKMSClient {
+	return &VaultKMSClient{Addr: addr, Token: token, HTTPClient: http.DefaultClient, loginDone: true}
+}
+
+// NewVaultAppRoleKMSClient builds a VaultKMSClient that logs in with an
+// AppRole role ID/secret ID on first use.
+func NewVaultAppRoleKMSClient(addr, roleID, secretID string) *VaultKMSClient {
+	return &VaultKMSClient{Addr: addr, AppRoleID: roleID, AppRoleSecret: secretID, HTTPClient: http.DefaultClient}
+}
+
+func (c *VaultKMSClient) ensureToken() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loginDone {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]string{
+		"role_id":   c.AppRoleID,
+		"secret_id": c.AppRoleSecret,
+	})
+	resp, err := c.HTTPClient.Post(c.Addr+"/v1/auth/approle/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("vault approle login: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault approle login: status %v", resp.StatusCode)
+	}
+	var loginResp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
+		return fmt.Errorf("vault approle login: decode response: %v", err)
+	}
+	c.Token = loginResp.Auth.ClientToken
+	c.loginDone = true
+	return nil
+}
+
+func (c *VaultKMSClient) transit(action, keyName string, payload map[string]string) (map[string]string, error) {
+	if err := c.ensureToken(); err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%v/v1/transit/%v/%v", c.Addr, action, keyName), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault transit %v: %v", action, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault transit %v: status %v", action, resp.StatusCode)
+	}
+	var out struct {
+		Data map[string]string `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("vault transit %v: decode response: %v", action, err)
+	}
+	return out.Data, nil
+}
+
+func (c *VaultKMSClient) WrapKey(keyName string, plaintext []byte) ([]byte, error) {
+	data, err := c.transit("encrypt", keyName, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data["ciphertext"]), nil
+}
+
+func (c *VaultKMSClient) UnwrapKey(keyName string, ciphertext []byte) ([]byte, error) {
+	data, err := c.transit("decrypt", keyName, map[string]string{"ciphertext": string(ciphertext)})
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(data["plaintext"])
+}
+
+// LocalFileKMSClient is a dev/test-only KMSClient that wraps key material
+// with AES-GCM under a single master key read from a local file. It MUST
+// NOT be used in production; it exists so the SSE code paths can be
+// exercised without standing up Vault.
+type LocalFileKMSClient struct {
+	masterKey []byte
+}
+
+// NewLocalFileKMSClient reads a 32-byte AES-256 master key from keyPath.
+func NewLocalFileKMSClient(keyPath string) (*LocalFileKMSClient, error) {
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read local kms master key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("local kms master key at %v must be 32 bytes, got %v", keyPath, len(key))
+	}
+	return &LocalFileKMSClient{masterKey: key}, nil
+}
+
+// GenerateLocalKMSMasterKey writes a fresh random 32-byte master key to
+// keyPath, for bootstrapping a dev environment.
+func GenerateLocalKMSMasterKey(keyPath string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath, key, os.FileMode(0600))
+}
+
+func (c *LocalFileKMSClient) WrapKey(keyName string, plaintext []byte) ([]byte, error) {
+	return aesGCMSeal(c.masterKey, plaintext)
+}
+
+func (c *LocalFileKMSClient) UnwrapKey(keyName string, ciphertext []byte) ([]byte, error) {
+	return aesGCMOpen(c.masterKey, ciphertext)
+}
+
+func aesGCMSeal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func aesGCMOpen(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext shorter than gcm nonce")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
@@ -0,0 +1,333 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/chubaofs/chubaofs/util/log"
+)
+
+const (
+	metricsNamespace = "chubaofs"
+	metricsSubsystem = "objectnode"
+
+	// defaultMetricsCollectInterval is how often a volume's usage metrics
+	// are refreshed in the background.
+	defaultMetricsCollectInterval = time.Minute
+
+	// defaultMetricsCacheTTL bounds how long VolumeUsage serves a cached
+	// snapshot before triggering an on-demand collection.
+	defaultMetricsCacheTTL = 30 * time.Second
+
+	// defaultMetricsConcurrency caps how many volumes may be collected at
+	// once, so thousands of loaded buckets can't all hit the master
+	// simultaneously.
+	defaultMetricsConcurrency = 4
+)
+
+// VolumeMetrics is a point-in-time usage snapshot for a volume.
+type VolumeMetrics struct {
+	Capacity      uint64
+	Used          uint64
+	InodesUsed    uint64
+	ObjectCount   uint64
+	LastCollected time.Time
+}
+
+// CollectorType selects how a volume's usage metrics are measured, trading
+// off accuracy against collection cost.
+type CollectorType int
+
+const (
+	// CollectorFast reads cheap, metadata-only counters without walking
+	// the volume's namespace. It is the default.
+	CollectorFast CollectorType = iota
+	// CollectorFull collects through Volume.walkUsage. It does not walk
+	// the volume's namespace: it reads the same master-reported figures as
+	// CollectorFast, and its object count is the same inode-count
+	// approximation.
+	CollectorFull
+)
+
+// VolumeMetricsCollector produces a VolumeMetrics snapshot for a volume.
+type VolumeMetricsCollector interface {
+	Collect(vol *Volume) (VolumeMetrics, error)
+}
+
+func collectorFor(t CollectorType) VolumeMetricsCollector {
+	if t == CollectorFull {
+		return fullVolumeMetricsCollector{}
+	}
+	return fastVolumeMetricsCollector{}
+}
+
+// fastVolumeMetricsCollector reads the volume's cached statfs-style quota
+// counters rather than walking its namespace.
+type fastVolumeMetricsCollector struct{}
+
+func (fastVolumeMetricsCollector) Collect(vol *Volume) (metrics VolumeMetrics, err error) {
+	if metrics.Capacity, metrics.Used, metrics.InodesUsed, err = vol.statFS(); err != nil {
+		return
+	}
+	metrics.ObjectCount, err = vol.approximateObjectCount()
+	metrics.LastCollected = time.Now()
+	return
+}
+
+// fullVolumeMetricsCollector reports the figures from Volume.walkUsage; it
+// performs no namespace walk and its object count is not exact.
+type fullVolumeMetricsCollector struct{}
+
+func (fullVolumeMetricsCollector) Collect(vol *Volume) (metrics VolumeMetrics, err error) {
+	usage, err := vol.walkUsage()
+	if err != nil {
+		return
+	}
+	metrics.Capacity = usage.Capacity
+	metrics.Used = usage.Used
+	metrics.InodesUsed = usage.InodesUsed
+	metrics.ObjectCount = usage.ObjectCount
+	metrics.LastCollected = time.Now()
+	return
+}
+
+// volumeMetricsState tracks the collector and cached snapshot for one
+// volume's usage metrics.
+type volumeMetricsState struct {
+	mu        sync.Mutex
+	collector VolumeMetricsCollector
+	cached    VolumeMetrics
+}
+
+func newVolumeMetricsState() *volumeMetricsState {
+	return &volumeMetricsState{collector: collectorFor(CollectorFast)}
+}
+
+// volumeMetricsRegistry holds the VolumeManager-scoped Prometheus gauges and
+// per-volume collection state backing VolumeUsage and MetricsHandler. states
+// is keyed by *volumeEntry rather than volume name so that a volume evicted
+// and reloaded under the same name gets a fresh state: the old entry's
+// background collector notices eviction on its own schedule, and must not be
+// able to forgetState() the new entry's state out from under it.
+type volumeMetricsRegistry struct {
+	mu            sync.RWMutex
+	states        map[*volumeEntry]*volumeMetricsState
+	cacheTTL      time.Duration
+	sem           chan struct{}
+	registry      *prometheus.Registry
+	usedGauge     *prometheus.GaugeVec
+	capacityGauge *prometheus.GaugeVec
+	objectsGauge  *prometheus.GaugeVec
+}
+
+func newVolumeMetricsRegistry() *volumeMetricsRegistry {
+	reg := prometheus.NewRegistry()
+	r := &volumeMetricsRegistry{
+		states:   make(map[*volumeEntry]*volumeMetricsState),
+		cacheTTL: defaultMetricsCacheTTL,
+		sem:      make(chan struct{}, defaultMetricsConcurrency),
+		registry: reg,
+		usedGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "volume_used",
+			Help:      "Bytes used on the volume.",
+		}, []string{"volume"}),
+		capacityGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "volume_capacity",
+			Help:      "Total capacity of the volume in bytes.",
+		}, []string{"volume"}),
+		objectsGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "volume_objects",
+			Help:      "Number of objects stored on the volume.",
+		}, []string{"volume"}),
+	}
+	reg.MustRegister(r.usedGauge, r.capacityGauge, r.objectsGauge)
+	return r
+}
+
+func (r *volumeMetricsRegistry) stateFor(entry *volumeEntry) *volumeMetricsState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, ok := r.states[entry]
+	if !ok {
+		st = newVolumeMetricsState()
+		r.states[entry] = st
+	}
+	return st
+}
+
+// forgetState drops entry's collection state once it has been evicted from
+// the VolumeManager. It is always safe to call: states is keyed by
+// *volumeEntry, so it can never touch a different entry reloaded under the
+// same volume name.
+func (r *volumeMetricsRegistry) forgetState(entry *volumeEntry) {
+	r.mu.Lock()
+	delete(r.states, entry)
+	r.mu.Unlock()
+}
+
+// forgetGauges clears volName's exported gauge labels. Callers must only
+// call this once they've established volName hasn't already been reloaded
+// under a fresh entry, or this would wipe that entry's live metrics out from
+// under it.
+func (r *volumeMetricsRegistry) forgetGauges(volName string) {
+	r.usedGauge.DeleteLabelValues(volName)
+	r.capacityGauge.DeleteLabelValues(volName)
+	r.objectsGauge.DeleteLabelValues(volName)
+}
+
+// forgetMetrics drops entry's collection state and, if volName hasn't since
+// been reloaded under a new entry, its exported gauge labels too. The
+// liveness recheck matters because pinForBackground having already returned
+// false only proves entry is stale at that moment; by the time the
+// background goroutine gets here, a concurrent Acquire may have loaded a
+// fresh entry for volName and started publishing its own metrics under the
+// same labels.
+func (m *VolumeManager) forgetMetrics(volName string, entry *volumeEntry) {
+	m.metrics.forgetState(entry)
+	m.volMu.RLock()
+	reloaded := m.volumes[volName] != nil
+	m.volMu.RUnlock()
+	if !reloaded {
+		m.metrics.forgetGauges(volName)
+	}
+}
+
+// SetVolumeCollectorType selects whether volName's usage metrics are
+// collected with CollectorFast (the default) or CollectorFull. Both read
+// master-reported aggregates; neither walks the namespace. It is a no-op if
+// volName isn't currently loaded.
+func (m *VolumeManager) SetVolumeCollectorType(volName string, t CollectorType) {
+	m.volMu.RLock()
+	entry, ok := m.volumes[volName]
+	m.volMu.RUnlock()
+	if !ok {
+		return
+	}
+	st := m.metrics.stateFor(entry)
+	st.mu.Lock()
+	st.collector = collectorFor(t)
+	st.mu.Unlock()
+}
+
+// SetMetricsPolicy tunes the usage-metrics cache TTL and how many volumes
+// may be collected concurrently.
+func (m *VolumeManager) SetMetricsPolicy(cacheTTL time.Duration, maxConcurrency int) {
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultMetricsConcurrency
+	}
+	m.metrics.mu.Lock()
+	m.metrics.cacheTTL = cacheTTL
+	m.metrics.sem = make(chan struct{}, maxConcurrency)
+	m.metrics.mu.Unlock()
+}
+
+// VolumeUsage returns volName's usage metrics, serving a cached snapshot if
+// it is still within the configured TTL and collecting a fresh one
+// otherwise.
+func (m *VolumeManager) VolumeUsage(volName string) (VolumeMetrics, error) {
+	handle, err := m.Acquire(volName)
+	if err != nil {
+		return VolumeMetrics{}, err
+	}
+	defer handle.Release()
+
+	st := m.metrics.stateFor(handle.entry)
+	st.mu.Lock()
+	cached := st.cached
+	st.mu.Unlock()
+
+	m.metrics.mu.RLock()
+	ttl := m.metrics.cacheTTL
+	m.metrics.mu.RUnlock()
+	if !cached.LastCollected.IsZero() && time.Since(cached.LastCollected) < ttl {
+		return cached, nil
+	}
+	return m.collectVolumeMetrics(volName, handle.entry)
+}
+
+func (m *VolumeManager) collectVolumeMetrics(volName string, entry *volumeEntry) (VolumeMetrics, error) {
+	m.metrics.mu.RLock()
+	sem := m.metrics.sem
+	m.metrics.mu.RUnlock()
+	sem <- struct{}{}
+	defer func() { <-sem }()
+
+	st := m.metrics.stateFor(entry)
+	st.mu.Lock()
+	collector := st.collector
+	st.mu.Unlock()
+
+	snapshot, err := collector.Collect(entry.vol)
+	if err != nil {
+		return VolumeMetrics{}, err
+	}
+
+	st.mu.Lock()
+	st.cached = snapshot
+	st.mu.Unlock()
+
+	m.metrics.usedGauge.WithLabelValues(volName).Set(float64(snapshot.Used))
+	m.metrics.capacityGauge.WithLabelValues(volName).Set(float64(snapshot.Capacity))
+	m.metrics.objectsGauge.WithLabelValues(volName).Set(float64(snapshot.ObjectCount))
+
+	return snapshot, nil
+}
+
+// MetricsHandler serves the chubaofs_objectnode_volume_{used,capacity,objects}
+// gauges, labeled by volume, for scraping by Prometheus.
+func (m *VolumeManager) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(m.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// scheduleMetricsCollection starts a background goroutine that refreshes
+// volName's usage metrics every defaultMetricsCollectInterval, with a random
+// initial jitter so volumes loaded around the same time don't all collect in
+// lockstep. It stops once the volume is evicted or the manager is closed.
+func (m *VolumeManager) scheduleMetricsCollection(volName string, entry *volumeEntry) {
+	jitter := time.Duration(rand.Int63n(int64(defaultMetricsCollectInterval)))
+	go func() {
+		timer := time.NewTimer(jitter)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-m.stopCh:
+				return
+			}
+			if !m.pinForBackground(volName, entry) {
+				m.forgetMetrics(volName, entry)
+				return
+			}
+			if _, err := m.collectVolumeMetrics(volName, entry); err != nil {
+				log.LogErrorf("scheduleMetricsCollection: collect volume(%v) metrics fail: err(%v)", volName, err)
+			}
+			m.releaseHandle(entry)
+			timer.Reset(defaultMetricsCollectInterval)
+		}
+	}()
+}
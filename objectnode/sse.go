@@ -0,0 +1,258 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/chubaofs/chubaofs/util/log"
+)
+
+// SSEType identifies which server-side-encryption mode a PUT/GET is using.
+// It is derived from the x-amz-server-side-encryption request headers, but
+// resolving the raw header values into one of these is left to the caller.
+type SSEType string
+
+const (
+	SSENone    SSEType = ""
+	SSETypeC   SSEType = "SSE-C"
+	SSETypeS3  SSEType = "SSE-S3"
+	SSETypeKMS SSEType = "SSE-KMS"
+)
+
+// bucketKEKName is the name under which a volume's bucket key-encryption
+// key is wrapped/unwrapped by the configured KMSClient.
+func bucketKEKName(volName string) string {
+	return fmt.Sprintf("objectnode-volume-%v", volName)
+}
+
+// bucketKEK returns volName's plaintext bucket key-encryption key,
+// provisioning and persisting one on first use. It is the shared building
+// block for SSE-S3 (used directly as the data-encryption key) and SSE-KMS
+// (used to wrap a fresh per-object data-encryption key).
+func (m *VolumeManager) bucketKEK(volName string) ([]byte, error) {
+	if m.kms == nil {
+		return nil, errors.New("kms client not configured")
+	}
+	if m.store == nil {
+		return nil, errors.New("volume store not configured")
+	}
+	meta, err := m.store.Get(volName)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil && len(meta.WrappedKEK) > 0 {
+		return m.kms.UnwrapKey(bucketKEKName(volName), meta.WrappedKEK)
+	}
+
+	// No KEK provisioned yet: serialize against any other caller racing to
+	// provision the same volume's first key, then re-read the store in case
+	// the lock's previous holder already finished provisioning it.
+	release := m.syncKEKInit(volName)
+	defer release()
+	meta, err = m.store.Get(volName)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil && len(meta.WrappedKEK) > 0 {
+		return m.kms.UnwrapKey(bucketKEKName(volName), meta.WrappedKEK)
+	}
+	return m.provisionBucketKEK(volName, meta)
+}
+
+func (m *VolumeManager) provisionBucketKEK(volName string, meta *VolumeMeta) ([]byte, error) {
+	plainKEK := make([]byte, 32)
+	if _, err := rand.Read(plainKEK); err != nil {
+		return nil, err
+	}
+	wrapped, err := m.kms.WrapKey(bucketKEKName(volName), plainKEK)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		meta = new(VolumeMeta)
+	}
+	meta.WrappedKEK = wrapped
+	meta.KeyVersion = 1
+	if err = m.store.Put(volName, meta); err != nil {
+		return nil, err
+	}
+	return plainKEK, nil
+}
+
+// BucketManagedKey returns volName's gateway-managed data-encryption key for
+// SSE-S3 PUT/GET paths.
+func (m *VolumeManager) BucketManagedKey(volName string) ([]byte, error) {
+	return m.bucketKEK(volName)
+}
+
+// WrapObjectDEK wraps a freshly generated per-object data-encryption key
+// with volName's bucket key-encryption key, for the SSE-KMS PUT path. The
+// returned blob is opaque and should be stored alongside the object's
+// metadata so UnwrapObjectDEK can recover the DEK on GET.
+func (m *VolumeManager) WrapObjectDEK(volName string, dek []byte) ([]byte, error) {
+	kek, err := m.bucketKEK(volName)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCMSeal(kek, dek)
+}
+
+// UnwrapObjectDEK reverses WrapObjectDEK for the SSE-KMS GET path.
+func (m *VolumeManager) UnwrapObjectDEK(volName string, wrapped []byte) ([]byte, error) {
+	kek, err := m.bucketKEK(volName)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCMOpen(kek, wrapped)
+}
+
+// RotateKey re-wraps volName's bucket key-encryption key under the KMS
+// client's current master key, without rewriting any object data: it fetches
+// the currently wrapped KEK, unwraps it, re-wraps the same plaintext KEK and
+// atomically swaps the stored blob, bumping KeyVersion. Objects encrypted
+// under the previous wrap remain decryptable because the plaintext KEK
+// itself never changes, only the blob protecting it at rest.
+func (m *VolumeManager) RotateKey(volName string) error {
+	if m.kms == nil {
+		return errors.New("kms client not configured")
+	}
+	if m.store == nil {
+		return errors.New("volume store not configured")
+	}
+	meta, err := m.store.Get(volName)
+	if err != nil {
+		return err
+	}
+	if meta == nil || len(meta.WrappedKEK) == 0 {
+		return fmt.Errorf("no encryption key provisioned for volume(%v)", volName)
+	}
+
+	// Serialize against bucketKEK's first-provisioning path and against any
+	// other concurrent RotateKey call, so two rotations can't interleave a
+	// read-unwrap-rewrap-write and silently drop one's KeyVersion bump.
+	release := m.syncKEKInit(volName)
+	defer release()
+	meta, err = m.store.Get(volName)
+	if err != nil {
+		return err
+	}
+	if meta == nil || len(meta.WrappedKEK) == 0 {
+		return fmt.Errorf("no encryption key provisioned for volume(%v)", volName)
+	}
+
+	kekName := bucketKEKName(volName)
+	plainKEK, err := m.kms.UnwrapKey(kekName, meta.WrappedKEK)
+	if err != nil {
+		return fmt.Errorf("unwrap current key for volume(%v): %v", volName, err)
+	}
+	rewrapped, err := m.kms.WrapKey(kekName, plainKEK)
+	if err != nil {
+		return fmt.Errorf("rewrap key for volume(%v): %v", volName, err)
+	}
+
+	meta.WrappedKEK = rewrapped
+	meta.KeyVersion++
+	if err = m.store.Put(volName, meta); err != nil {
+		return fmt.Errorf("persist rotated key for volume(%v): %v", volName, err)
+	}
+	log.LogInfof("RotateKey: rotated encryption key for volume(%v) to version(%v)", volName, meta.KeyVersion)
+	return nil
+}
+
+// ObjectSSEParams carries the server-side-encryption inputs a PUT/GET
+// handler would parse off the x-amz-server-side-encryption request headers.
+// CustomerKey/CustomerKeyMD5 are only meaningful for SSETypeC; StoredDEK is
+// only meaningful for SSETypeKMS, where it is the opaque blob a PUT stashes
+// in the object's metadata and a GET reads back.
+type ObjectSSEParams struct {
+	Type           SSEType
+	CustomerKey    []byte
+	CustomerKeyMD5 string
+	StoredDEK      []byte
+}
+
+// PrepareObjectEncryption resolves the data-encryption key a PUT handler
+// should encrypt the object body with, for whichever SSE mode params.Type
+// selects. For SSE-KMS it also returns the wrapped per-object DEK the caller
+// must persist in the object's metadata so ResolveObjectDecryption can
+// recover the same key later; for the other modes storedDEK is nil, since
+// SSE-C's key never leaves the request and SSE-S3 rederives the same bucket
+// key on every GET.
+func (m *VolumeManager) PrepareObjectEncryption(volName string, params ObjectSSEParams) (dek []byte, storedDEK []byte, err error) {
+	switch params.Type {
+	case SSENone:
+		return nil, nil, nil
+	case SSETypeC:
+		if err = ValidateCustomerKey(params.CustomerKey, params.CustomerKeyMD5); err != nil {
+			return nil, nil, err
+		}
+		return params.CustomerKey, nil, nil
+	case SSETypeS3:
+		dek, err = m.BucketManagedKey(volName)
+		return dek, nil, err
+	case SSETypeKMS:
+		dek = make([]byte, 32)
+		if _, err = rand.Read(dek); err != nil {
+			return nil, nil, err
+		}
+		storedDEK, err = m.WrapObjectDEK(volName, dek)
+		return dek, storedDEK, err
+	default:
+		return nil, nil, fmt.Errorf("unsupported sse type(%v)", params.Type)
+	}
+}
+
+// ResolveObjectDecryption recovers the data-encryption key a GET handler
+// should decrypt the object body with, the inverse of
+// PrepareObjectEncryption for each SSE mode.
+func (m *VolumeManager) ResolveObjectDecryption(volName string, params ObjectSSEParams) ([]byte, error) {
+	switch params.Type {
+	case SSENone:
+		return nil, nil
+	case SSETypeC:
+		if err := ValidateCustomerKey(params.CustomerKey, params.CustomerKeyMD5); err != nil {
+			return nil, err
+		}
+		return params.CustomerKey, nil
+	case SSETypeS3:
+		return m.BucketManagedKey(volName)
+	case SSETypeKMS:
+		return m.UnwrapObjectDEK(volName, params.StoredDEK)
+	default:
+		return nil, fmt.Errorf("unsupported sse type(%v)", params.Type)
+	}
+}
+
+// ValidateCustomerKey checks an SSE-C key supplied on a PUT/GET request
+// against the expected length and, if provided, its base64-encoded MD5
+// fingerprint (the x-amz-server-side-encryption-customer-key-MD5 header).
+func ValidateCustomerKey(key []byte, expectedMD5 string) error {
+	if len(key) != 32 {
+		return errors.New("sse-c customer key must be 256 bits")
+	}
+	if expectedMD5 == "" {
+		return nil
+	}
+	sum := md5.Sum(key)
+	if base64.StdEncoding.EncodeToString(sum[:]) != expectedMD5 {
+		return errors.New("sse-c customer key md5 mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+// Store persists per-volume metadata across gateway restarts so a
+// VolumeManager does not have to re-fetch everything from the master on
+// cold start. Implementations must be safe for concurrent use.
+type Store interface {
+	// Init wires the store to its owning VolumeManager.
+	Init(vm *VolumeManager)
+	// Get returns the persisted metadata for volName, or (nil, nil) if
+	// nothing has been stored for it yet.
+	Get(volName string) (*VolumeMeta, error)
+	Put(volName string, meta *VolumeMeta) error
+	Delete(volName string) error
+	// List returns every persisted record, keyed by volume name.
+	List() (map[string]*VolumeMeta, error)
+	Close() error
+}
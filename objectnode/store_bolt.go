@@ -0,0 +1,140 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/chubaofs/chubaofs/util/log"
+)
+
+var volumesBucketName = []byte("volumes")
+
+var _ Store = (*BoltStore)(nil)
+
+// VolumeMeta is the per-bucket metadata a Store persists so the object
+// gateway does not have to re-fetch everything from the master on cold
+// start: the OSS access keys plus the raw CORS/policy/lifecycle/tagging
+// blobs as last seen from the master.
+type VolumeMeta struct {
+	AccessKey string
+	SecretKey string
+	CORS      []byte
+	Policy    []byte
+	Lifecycle []byte
+	Tagging   []byte
+
+	// WrappedKEK is the volume's bucket key-encryption key, wrapped by the
+	// configured KMSClient. Empty until the first SSE-S3/SSE-KMS key
+	// request provisions it; RotateKey returns an error while it is empty.
+	// See kms.go and sse.go.
+	WrappedKEK []byte
+	// KeyVersion is 1 once WrappedKEK is provisioned and is bumped every
+	// time RotateKey re-wraps it. It is a counter only: rotation keeps the
+	// plaintext KEK unchanged, which is what keeps older objects
+	// decryptable.
+	KeyVersion int
+}
+
+// BoltStore is a Store implementation backed by a local bbolt database: a
+// single "volumes" bucket keyed by volume name holding a JSON-encoded
+// VolumeMeta blob. A single bucket keeps List() (used to reconcile the cache
+// on startup) a single linear scan instead of a bucket-per-volume fan-out.
+type BoltStore struct {
+	dbPath string
+	db     *bolt.DB
+	vm     *VolumeManager
+	mu     sync.Mutex
+}
+
+// NewBoltStore opens (creating if necessary) the bbolt database at dbPath
+// and ensures the volumes bucket exists.
+func NewBoltStore(dbPath string) (*BoltStore, error) {
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open bolt store %v: %v", dbPath, err)
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, createErr := tx.CreateBucketIfNotExists(volumesBucketName)
+		return createErr
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("init volumes bucket: %v", err)
+	}
+	return &BoltStore{dbPath: dbPath, db: db}, nil
+}
+
+func (s *BoltStore) Init(vm *VolumeManager) {
+	s.mu.Lock()
+	s.vm = vm
+	s.mu.Unlock()
+}
+
+// Get returns the stored metadata for volName, or (nil, nil) if nothing has
+// been persisted for it yet.
+func (s *BoltStore) Get(volName string) (meta *VolumeMeta, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(volumesBucketName).Get([]byte(volName))
+		if raw == nil {
+			return nil
+		}
+		meta = new(VolumeMeta)
+		return json.Unmarshal(raw, meta)
+	})
+	return
+}
+
+func (s *BoltStore) Put(volName string, meta *VolumeMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(volumesBucketName).Put([]byte(volName), raw)
+	})
+}
+
+func (s *BoltStore) Delete(volName string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(volumesBucketName).Delete([]byte(volName))
+	})
+}
+
+// List returns every volume record currently persisted, keyed by volume
+// name. A record that fails to decode is logged and skipped rather than
+// failing the whole listing.
+func (s *BoltStore) List() (map[string]*VolumeMeta, error) {
+	all := make(map[string]*VolumeMeta)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(volumesBucketName).ForEach(func(k, v []byte) error {
+			meta := new(VolumeMeta)
+			if unmarshalErr := json.Unmarshal(v, meta); unmarshalErr != nil {
+				log.LogErrorf("BoltStore.List: decode volume(%v) meta fail: err(%v)", string(k), unmarshalErr)
+				return nil
+			}
+			all[string(k)] = meta
+			return nil
+		})
+	})
+	return all, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}